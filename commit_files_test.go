@@ -28,7 +28,7 @@ func TestCommitFilesTableRowIter(t *testing.T) {
 	repos, err := s.Pool.RepoIter()
 	require.NoError(err)
 	for {
-		repo, err := repos.Next()
+		repo, err := repos.Next(ctx.Context())
 		if err == io.EOF {
 			break
 		}
@@ -0,0 +1,183 @@
+package gitquery
+
+import (
+	"container/list"
+	"io"
+	"sync"
+)
+
+// Stats reports repository cache hit/miss counters for observability.
+type Stats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+// repositoryCache memoizes open *Repository handles keyed by ID, evicting
+// the least-recently-used entry once maxOpen handles are open. Entries are
+// reference counted so an eviction never closes a handle that's still in
+// use by a rowReader.
+type repositoryCache struct {
+	mu      sync.Mutex
+	maxOpen int
+	entries map[string]*list.Element
+	order   *list.List // front: most recently used
+
+	hits   uint64
+	misses uint64
+}
+
+type cacheEntry struct {
+	id       string
+	repo     *Repository
+	refCount int
+}
+
+func newRepositoryCache(maxOpen int) *repositoryCache {
+	return &repositoryCache{
+		maxOpen: maxOpen,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+// acquire returns the cached repository for id, opening it with load if
+// it's not already cached. The caller must call release(id) once it's
+// done using the returned Repository.
+func (c *repositoryCache) acquire(
+	id string,
+	load func() (Repository, error),
+) (*Repository, error) {
+	if entry, ok := c.touch(id); ok {
+		return entry, nil
+	}
+
+	repo, err := load()
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// another goroutine may have opened the same id meanwhile
+	if el, ok := c.entries[id]; ok {
+		c.order.MoveToFront(el)
+		entry := el.Value.(*cacheEntry)
+		entry.refCount++
+		return entry.repo, nil
+	}
+
+	entry := &cacheEntry{id: id, repo: &repo, refCount: 1}
+	c.entries[id] = c.order.PushFront(entry)
+
+	c.evict()
+
+	return entry.repo, nil
+}
+
+func (c *repositoryCache) touch(id string) (*Repository, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[id]
+	if !ok {
+		c.misses++
+		return nil, false
+	}
+
+	c.order.MoveToFront(el)
+	entry := el.Value.(*cacheEntry)
+	entry.refCount++
+	c.hits++
+
+	return entry.repo, true
+}
+
+// release drops a reference acquired for id. Once an entry has no
+// references it becomes eligible for eviction.
+func (c *repositoryCache) release(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[id]
+	if !ok {
+		return
+	}
+
+	entry := el.Value.(*cacheEntry)
+	if entry.refCount > 0 {
+		entry.refCount--
+	}
+}
+
+// evict closes and removes unreferenced entries, starting from the
+// least-recently-used, until the cache is at or below maxOpen. Must be
+// called with c.mu held.
+func (c *repositoryCache) evict() {
+	if c.maxOpen <= 0 {
+		return
+	}
+
+	for el := c.order.Back(); el != nil && len(c.entries) > c.maxOpen; {
+		prev := el.Prev()
+		entry := el.Value.(*cacheEntry)
+
+		if entry.refCount == 0 {
+			closeRepository(entry.repo)
+			c.order.Remove(el)
+			delete(c.entries, entry.id)
+		}
+
+		el = prev
+	}
+}
+
+// Stats returns a snapshot of the cache's hit/miss counters.
+func (c *repositoryCache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return Stats{Hits: c.hits, Misses: c.misses}
+}
+
+// keyedMutex hands out a *sync.Mutex per key, so callers can serialize
+// access to a single repository ID without blocking unrelated ones. It's
+// used to make sure a repository is never opened twice concurrently when
+// combined with the repository cache.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*sync.Mutex
+}
+
+// Lock blocks until the mutex for key is acquired and returns a function
+// that releases it.
+func (k *keyedMutex) Lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*sync.Mutex)
+	}
+
+	l, ok := k.locks[key]
+	if !ok {
+		l = &sync.Mutex{}
+		k.locks[key] = l
+	}
+	k.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// closeRepository closes repo's underlying storer, if it supports it.
+// Plain on-disk repositories don't need closing, siva-backed ones do.
+func closeRepository(repo *Repository) error {
+	if repo == nil || repo.Repo == nil {
+		return nil
+	}
+
+	if closer, ok := repo.Repo.Storer.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
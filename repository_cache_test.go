@@ -0,0 +1,65 @@
+package gitquery
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepositoryCacheHitsAndMisses(t *testing.T) {
+	require := require.New(t)
+
+	c := newRepositoryCache(2)
+	loads := 0
+	load := func() (Repository, error) {
+		loads++
+		return NewRepository("0", nil), nil
+	}
+
+	_, err := c.acquire("0", load)
+	require.NoError(err)
+	_, err = c.acquire("0", load)
+	require.NoError(err)
+
+	require.Equal(1, loads)
+	require.Equal(Stats{Hits: 1, Misses: 1}, c.Stats())
+}
+
+func TestRepositoryCacheEvictsLRU(t *testing.T) {
+	require := require.New(t)
+
+	c := newRepositoryCache(1)
+
+	_, err := c.acquire("0", func() (Repository, error) {
+		return NewRepository("0", nil), nil
+	})
+	require.NoError(err)
+	c.release("0")
+
+	_, err = c.acquire("1", func() (Repository, error) {
+		return NewRepository("1", nil), nil
+	})
+	require.NoError(err)
+
+	require.Len(c.entries, 1)
+	_, ok := c.entries["0"]
+	require.False(ok)
+}
+
+func TestRepositoryCacheDoesNotEvictInUse(t *testing.T) {
+	require := require.New(t)
+
+	c := newRepositoryCache(1)
+
+	_, err := c.acquire("0", func() (Repository, error) {
+		return NewRepository("0", nil), nil
+	})
+	require.NoError(err)
+
+	_, err = c.acquire("1", func() (Repository, error) {
+		return NewRepository("1", nil), nil
+	})
+	require.NoError(err)
+
+	require.Len(c.entries, 2)
+}
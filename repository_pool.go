@@ -1,16 +1,43 @@
 package gitquery
 
 import (
+	"context"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"sync"
 
+	"gopkg.in/src-d/go-billy-siva.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
 	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
 	"gopkg.in/src-d/go-mysql-server.v0/sql"
 )
 
+// sivaExt is the extension used by siva-packed rooted repositories.
+const sivaExt = ".siva"
+
+// RepositoryKind identifies how a repository registered in a
+// RepositoryPool is stored on disk.
+type RepositoryKind byte
+
+const (
+	// Plain is a regular, on-disk git worktree.
+	Plain RepositoryKind = iota
+	// Bare is a bare on-disk git repository.
+	Bare
+	// Siva is a bare repository packed in a siva file, the format used
+	// by source{d}'s rooted repositories. A siva-backed Repository holds
+	// an open archive handle that's only ever closed by the pool's
+	// cache, so Siva entries require RepositoryPool.WithCache.
+	Siva
+)
+
 // Repository struct holds an initialized repository and its ID
 type Repository struct {
 	ID   string
@@ -36,45 +63,128 @@ func NewRepositoryFromPath(id, path string) (Repository, error) {
 	return NewRepository(id, repo), nil
 }
 
+// NewSivaRepositoryFromPath creates and initializes a new Repository
+// structure backed by a siva-packed bare repository, without unpacking
+// it to disk.
+func NewSivaRepositoryFromPath(id, path string) (Repository, error) {
+	localfs := osfs.New(filepath.Dir(path))
+
+	fs, err := sivafs.NewFilesystem(localfs, filepath.Base(path), memfs.New())
+	if err != nil {
+		return Repository{}, err
+	}
+
+	storer := filesystem.NewStorage(fs, cache.NewObjectLRUDefault())
+
+	repo, err := git.Open(storer, nil)
+	if err != nil {
+		return Repository{}, err
+	}
+
+	return NewRepository(id, repo), nil
+}
+
+// repoLoaders maps a RepositoryKind to the function used to open a
+// repository registered with that kind.
+var repoLoaders = map[RepositoryKind]func(id, path string) (Repository, error){
+	Plain: NewRepositoryFromPath,
+	Bare:  NewRepositoryFromPath,
+	Siva:  NewSivaRepositoryFromPath,
+}
+
+// repoEntry holds the path and storage kind of a repository registered
+// in a RepositoryPool.
+type repoEntry struct {
+	kind RepositoryKind
+	path string
+}
+
 // RepositoryPool holds a pool git repository paths and
 // functionality to open and iterate them.
 type RepositoryPool struct {
-	repositories map[string]string
+	repositories map[string]repoEntry
 	idOrder      []string
+	cache        *repositoryCache
+	openLocks    keyedMutex
+}
+
+// WithCache enables an LRU cache of open *git.Repository handles on the
+// pool. When a newly opened repository takes the cache above maxOpen,
+// least-recently-used entries that are not in use are closed and evicted;
+// entries still in use are kept, so the cache can hold more than maxOpen
+// handles for a while. A maxOpen of 0 or less disables eviction. Without a
+// cache, GetPos reopens a repository from scratch on every call.
+func (p *RepositoryPool) WithCache(maxOpen int) *RepositoryPool {
+	p.cache = newRepositoryCache(maxOpen)
+	return p
+}
+
+// Stats returns the repository cache's hit/miss counters. It returns a
+// zero Stats if the pool has no cache configured via WithCache.
+func (p *RepositoryPool) Stats() Stats {
+	if p.cache == nil {
+		return Stats{}
+	}
+
+	return p.cache.Stats()
+}
+
+// release gives back a repository handle acquired through GetPos, so a
+// cache (if configured) knows it's no longer in use and can evict it.
+func (p *RepositoryPool) release(id string) {
+	if p.cache != nil {
+		p.cache.release(id)
+	}
 }
 
 // NewRepositoryPool initializes a new RepositoryPool
 func NewRepositoryPool() RepositoryPool {
 	return RepositoryPool{
-		repositories: make(map[string]string),
+		repositories: make(map[string]repoEntry),
 	}
 }
 
-// Add inserts a new repository in the pool
+// Add inserts a new repository in the pool as a plain, on-disk repository
 func (p *RepositoryPool) Add(id, path string) {
+	p.addWithKind(id, path, Plain)
+}
+
+// AddSiva inserts a new siva-packed bare repository in the pool
+func (p *RepositoryPool) AddSiva(id, path string) {
+	p.addWithKind(id, path, Siva)
+}
+
+func (p *RepositoryPool) addWithKind(id, path string, kind RepositoryKind) {
 	_, ok := p.repositories[id]
 	if !ok {
 		p.idOrder = append(p.idOrder, id)
 	}
 
-	p.repositories[id] = path
+	p.repositories[id] = repoEntry{kind: kind, path: path}
 }
 
-// AddGit checks if a git repository can be opened and adds it to the pool. It
-// also sets its path as ID.
+// AddGit checks if a git repository can be opened and adds it to the
+// pool, using its path as ID. It's registered with kind Bare if it's a
+// bare repository, or Plain otherwise.
 func (p *RepositoryPool) AddGit(path string) (string, error) {
-	_, err := git.PlainOpen(path)
+	repo, err := git.PlainOpen(path)
 	if err != nil {
 		return "", err
 	}
 
+	kind := Plain
+	if _, err := repo.Worktree(); err == git.ErrIsBareRepository {
+		kind = Bare
+	}
+
 	id := filepath.Base(path)
-	p.Add(id, path)
+	p.addWithKind(id, path, kind)
 
 	return id, nil
 }
 
-// AddDir adds all direct subdirectories from path as repos
+// AddDir adds all direct subdirectories from path as repos, and any siva
+// files found in it as siva-packed repos
 func (p *RepositoryPool) AddDir(path string) error {
 	dirs, err := ioutil.ReadDir(path)
 	if err != nil {
@@ -82,10 +192,16 @@ func (p *RepositoryPool) AddDir(path string) error {
 	}
 
 	for _, f := range dirs {
-		if f.IsDir() {
-			name := filepath.Join(path, f.Name())
+		name := filepath.Join(path, f.Name())
+
+		switch {
+		case f.IsDir():
 			// TODO: log that the repo could not be opened
 			p.AddGit(name)
+
+		case strings.HasSuffix(f.Name(), sivaExt):
+			id := strings.TrimSuffix(f.Name(), sivaExt)
+			p.AddSiva(id, name)
 		}
 	}
 
@@ -93,8 +209,14 @@ func (p *RepositoryPool) AddDir(path string) error {
 }
 
 // GetPos retrieves a repository at a given position. If the position is
-// out of bounds it returns io.EOF
-func (p *RepositoryPool) GetPos(pos int) (*Repository, error) {
+// out of bounds it returns io.EOF. The given context is checked before
+// opening the repository so a canceled query doesn't pay the cost of an
+// extra git.PlainOpen.
+func (p *RepositoryPool) GetPos(ctx context.Context, pos int) (*Repository, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
 	if pos >= len(p.repositories) {
 		return nil, io.EOF
 	}
@@ -104,8 +226,31 @@ func (p *RepositoryPool) GetPos(pos int) (*Repository, error) {
 		return nil, io.EOF
 	}
 
-	path := p.repositories[id]
-	repo, err := NewRepositoryFromPath(id, path)
+	entry := p.repositories[id]
+	loader, ok := repoLoaders[entry.kind]
+	if !ok {
+		return nil, fmt.Errorf("gitquery: unsupported repository kind %v", entry.kind)
+	}
+
+	if entry.kind == Siva && p.cache == nil {
+		return nil, fmt.Errorf(
+			"gitquery: repository %q is siva-packed, which requires RepositoryPool.WithCache "+
+				"so its open handle is closed when it's no longer needed", id,
+		)
+	}
+
+	load := func() (Repository, error) {
+		return loader(id, entry.path)
+	}
+
+	if p.cache != nil {
+		unlock := p.openLocks.Lock(id)
+		defer unlock()
+
+		return p.cache.acquire(id, load)
+	}
+
+	repo, err := load()
 	if err != nil {
 		return nil, err
 	}
@@ -130,9 +275,10 @@ type RepositoryIter struct {
 }
 
 // Next retrieves the next Repository. It returns io.EOF as error
-// when there are no more Repositories to retrieve.
-func (i *RepositoryIter) Next() (*Repository, error) {
-	r, err := i.pool.GetPos(i.pos)
+// when there are no more Repositories to retrieve, or the context's
+// error if it's canceled or its deadline expires.
+func (i *RepositoryIter) Next(ctx context.Context) (*Repository, error) {
+	r, err := i.pool.GetPos(ctx, i.pos)
 	if err != nil {
 		return nil, err
 	}
@@ -142,11 +288,40 @@ func (i *RepositoryIter) Next() (*Repository, error) {
 	return r, nil
 }
 
+// currentID returns the ID of the repository the next call to Next will
+// attempt to open, or "" if the iterator is already exhausted.
+func (i *RepositoryIter) currentID() string {
+	if i.pos >= len(i.pool.idOrder) {
+		return ""
+	}
+
+	return i.pool.idOrder[i.pos]
+}
+
 // Close finished iterator. It's no-op.
 func (i *RepositoryIter) Close() error {
 	return nil
 }
 
+// multiError aggregates every error collected while iterating a
+// RepositoryPool, so a single bad repository doesn't hide the others.
+type multiError struct {
+	errs []error
+}
+
+func (e *multiError) Error() string {
+	if len(e.errs) == 1 {
+		return e.errs[0].Error()
+	}
+
+	msgs := make([]string, len(e.errs))
+	for i, err := range e.errs {
+		msgs[i] = err.Error()
+	}
+
+	return fmt.Sprintf("%d errors occurred: %s", len(e.errs), strings.Join(msgs, "; "))
+}
+
 // RowRepoIter is the interface needed by each iterator
 // implementation
 type RowRepoIter interface {
@@ -158,27 +333,81 @@ type RowRepoIter interface {
 // RowRepoIter is used as the base to iterate over all the repositories
 // in the pool
 type rowRepoIter struct {
+	ctx            context.Context
 	repositoryIter *RepositoryIter
 	iter           RowRepoIter
+	opts           RowRepoIterOptions
+
+	wg        sync.WaitGroup
+	done      chan bool
+	fatal     chan error
+	fatalOnce sync.Once
+	repos     chan *Repository
+	rows      chan sql.Row
+
+	errMu sync.Mutex
+	errs  []error
+}
 
-	wg    sync.WaitGroup
-	done  chan bool
-	err   chan error
-	repos chan *Repository
-	rows  chan sql.Row
+// RowRepoIterOptions tunes the concurrency and error handling of a
+// rowRepoIter.
+type RowRepoIterOptions struct {
+	// Workers is the number of goroutines consuming repositories
+	// concurrently. Defaults to the smaller of runtime.NumCPU() and the
+	// number of repositories in the pool.
+	Workers int
+	// RepoBuffer is the size of the channel repositories are queued on
+	// before a worker picks them up. Defaults to unbuffered.
+	RepoBuffer int
+	// RowBuffer is the size of the channel produced rows are queued on.
+	// Defaults to unbuffered.
+	RowBuffer int
+	// SkipBrokenRepos, when true, downgrades a per-repository error
+	// (e.g. a corrupted packfile) to a warning: the repository is
+	// skipped and iteration continues over the rest of the pool, instead
+	// of the whole query failing. Every skipped error is still collected
+	// and returned from Close, and reported through OnBrokenRepo.
+	SkipBrokenRepos bool
+	// OnBrokenRepo, if set, is called for every repository error that
+	// SkipBrokenRepos downgrades to a warning.
+	OnBrokenRepo func(error)
+}
+
+func (o RowRepoIterOptions) workers(pool *RepositoryPool) int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+
+	workers := runtime.NumCPU()
+	if n := len(pool.repositories); n < workers {
+		workers = n
+	}
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	return workers
 }
 
 // NewRowRepoIter initializes a new repository iterator.
 //
+// * ctx: context used to cancel the iteration; once it's Done every
+//     goroutine spawned by this call tears down its repository handles
+//     and returns
 // * pool: is a RepositoryPool we want to iterate
 // * iter: specific RowRepoIter interface
 //     * NewIterator: called when a new repository is about to be iterated,
 //         returns a new RowRepoIter
 //     * Next: called for each row
 //     * Close: called when a repository finished iterating
+// * opts: tunes the number of workers and channel buffering; the zero
+//     value picks sensible defaults
 func NewRowRepoIter(
+	ctx context.Context,
 	pool *RepositoryPool,
 	iter RowRepoIter,
+	opts RowRepoIterOptions,
 ) (*rowRepoIter, error) {
 	rIter, err := pool.RepoIter()
 	if err != nil {
@@ -186,17 +415,19 @@ func NewRowRepoIter(
 	}
 
 	repoIter := rowRepoIter{
+		ctx:            ctx,
 		repositoryIter: rIter,
 		iter:           iter,
+		opts:           opts,
 		done:           make(chan bool),
-		err:            make(chan error),
-		repos:          make(chan *Repository),
-		rows:           make(chan sql.Row),
+		fatal:          make(chan error, 1),
+		repos:          make(chan *Repository, opts.RepoBuffer),
+		rows:           make(chan sql.Row, opts.RowBuffer),
 	}
 
 	go repoIter.fillRepoChannel()
 
-	wNum := runtime.NumCPU()
+	wNum := opts.workers(pool)
 
 	for i := 0; i < wNum; i++ {
 		repoIter.wg.Add(1)
@@ -215,32 +446,117 @@ func NewRowRepoIter(
 func (i *rowRepoIter) fillRepoChannel() {
 	for {
 		select {
+		case <-i.ctx.Done():
+			i.fail(i.ctx.Err())
+			i.drainRepos()
+			return
+
 		case <-i.done:
+			// a rowReader hit a fatal error first: drain and release
+			// whatever is left on i.repos, since nothing else will.
+			i.drainRepos()
 			return
 
 		default:
-			repo, err := i.repositoryIter.Next()
+			id := i.repositoryIter.currentID()
+			repo, err := i.repositoryIter.Next(i.ctx)
 
 			switch err {
 			case nil:
-				i.repos <- repo
-				continue
+				// A plain send here could block forever once every
+				// rowReader has exited on i.done, so race it against
+				// done/ctx too instead of stranding this repo's handle.
+				select {
+				case i.repos <- repo:
+					continue
+
+				case <-i.done:
+					i.repositoryIter.pool.release(repo.ID)
+					i.drainRepos()
+					return
+
+				case <-i.ctx.Done():
+					i.repositoryIter.pool.release(repo.ID)
+					i.fail(i.ctx.Err())
+					i.drainRepos()
+					return
+				}
 
 			case io.EOF:
 				close(i.repos)
-				i.err <- io.EOF
 				return
 
 			default:
-				close(i.done)
-				close(i.repos)
-				i.err <- err
+				wrapped := fmt.Errorf("gitquery: repository %q: %s", id, err)
+
+				if i.opts.SkipBrokenRepos {
+					i.warn(wrapped)
+					// Next doesn't advance past a repository it failed to
+					// open, so step over it here.
+					i.repositoryIter.pos++
+					continue
+				}
+
+				i.fail(wrapped)
+				i.drainRepos()
 				return
 			}
 		}
 	}
 }
 
+// drainRepos closes i.repos, the channel it's the sole owner of, and
+// releases every repository still buffered on it. Called whenever
+// iteration ends before reaching io.EOF, so a fatal error can never
+// strand a buffered repository's cache handle (or the rowReader blocked
+// waiting for it) for the rest of the query.
+func (i *rowRepoIter) drainRepos() {
+	close(i.repos)
+	for repo := range i.repos {
+		i.repositoryIter.pool.release(repo.ID)
+	}
+}
+
+// addError records err as part of the aggregated error returned by
+// Close, without affecting iteration.
+func (i *rowRepoIter) addError(err error) {
+	i.errMu.Lock()
+	i.errs = append(i.errs, err)
+	i.errMu.Unlock()
+}
+
+// warn records err and, if configured, reports it through OnBrokenRepo.
+// Used for per-repository errors downgraded by SkipBrokenRepos.
+func (i *rowRepoIter) warn(err error) {
+	i.addError(err)
+	if i.opts.OnBrokenRepo != nil {
+		i.opts.OnBrokenRepo(err)
+	}
+}
+
+// stop closes i.done exactly once, waking every goroutine blocked on a
+// channel send (or idle waiting for one) so it can release its
+// repository handle and exit.
+func (i *rowRepoIter) stop() {
+	i.fatalOnce.Do(func() {
+		close(i.done)
+	})
+}
+
+// fail records err, stops iteration via stop, and surfaces err as the
+// next fatal error from Next. The fatal channel holds at most one pending
+// error: a call made while one is pending doesn't send, but every call
+// still contributes to the aggregated error.
+func (i *rowRepoIter) fail(err error) {
+	i.addError(err)
+	i.stop()
+
+	select {
+	case i.fatal <- err:
+	default:
+	}
+}
+
 func (i *rowRepoIter) rowReader(num int) {
 	defer i.wg.Done()
 
@@ -250,24 +566,56 @@ func (i *rowRepoIter) rowReader(num int) {
 	loop:
 		for {
 			select {
+			case <-i.ctx.Done():
+				iter.Close()
+				i.repositoryIter.pool.release(repo.ID)
+				return
+
 			case <-i.done:
 				iter.Close()
+				i.repositoryIter.pool.release(repo.ID)
 				return
 
 			default:
 				row, err := iter.Next()
 				switch err {
 				case nil:
-					i.rows <- row
+					// As with the i.repos send in fillRepoChannel, a
+					// bare send here would block forever once Next
+					// stops being called (context canceled, or the
+					// caller did a LIMIT and Close'd early), leaking
+					// this goroutine and its repository handle.
+					select {
+					case i.rows <- row:
+
+					case <-i.done:
+						iter.Close()
+						i.repositoryIter.pool.release(repo.ID)
+						return
+
+					case <-i.ctx.Done():
+						iter.Close()
+						i.repositoryIter.pool.release(repo.ID)
+						return
+					}
 
 				case io.EOF:
 					iter.Close()
+					i.repositoryIter.pool.release(repo.ID)
 					break loop
 
 				default:
 					iter.Close()
-					i.err <- err
-					close(i.done)
+					i.repositoryIter.pool.release(repo.ID)
+
+					wrapped := fmt.Errorf("gitquery: repository %q: %s", repo.ID, err)
+
+					if i.opts.SkipBrokenRepos {
+						i.warn(wrapped)
+						break loop
+					}
+
+					i.fail(wrapped)
 					return
 				}
 			}
@@ -277,15 +625,42 @@ func (i *rowRepoIter) rowReader(num int) {
 
 // Next gets the next row
 func (i *rowRepoIter) Next() (sql.Row, error) {
-	row, ok := <-i.rows
-	if !ok {
-		return nil, <-i.err
-	}
+	select {
+	case <-i.ctx.Done():
+		return nil, i.ctx.Err()
+	case err := <-i.fatal:
+		return nil, err
+	case row, ok := <-i.rows:
+		if !ok {
+			return nil, io.EOF
+		}
 
-	return row, nil
+		return row, nil
+	}
 }
 
-// Close called to close the iterator
+// Close called to close the iterator. It returns an aggregated error
+// for every repository that failed during iteration, including those
+// downgraded to warnings by SkipBrokenRepos, or nil if none did.
+//
+// Close always stops iteration, even if the caller never saw a fatal
+// error or canceled its context (e.g. a query that did a LIMIT and
+// stopped calling Next early): without this, a rowReader or
+// fillRepoChannel blocked mid-send would leak its goroutine and never
+// release its repository handle.
 func (i *rowRepoIter) Close() error {
-	return i.iter.Close()
+	i.stop()
+
+	if err := i.iter.Close(); err != nil {
+		i.addError(err)
+	}
+
+	i.errMu.Lock()
+	defer i.errMu.Unlock()
+
+	if len(i.errs) == 0 {
+		return nil
+	}
+
+	return &multiError{errs: i.errs}
 }
@@ -1,13 +1,17 @@
 package gitquery
 
 import (
+	"context"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"gopkg.in/src-d/go-git-fixtures.v3"
@@ -35,33 +39,34 @@ func TestRepositoryPoolBasic(t *testing.T) {
 	require := require.New(t)
 
 	pool := NewRepositoryPool()
+	ctx := context.Background()
 
 	// GetPos
 
-	repo, err := pool.GetPos(0)
+	repo, err := pool.GetPos(ctx, 0)
 	require.Nil(repo)
 	require.Equal(io.EOF, err)
 
 	// Add and GetPos
 
 	pool.Add("0", "/directory/should/not/exist")
-	repo, err = pool.GetPos(0)
+	repo, err = pool.GetPos(ctx, 0)
 	require.NotNil(err)
 
-	_, err = pool.GetPos(1)
+	_, err = pool.GetPos(ctx, 1)
 	require.Equal(io.EOF, err)
 
 	path := fixtures.Basic().ByTag("worktree").One().Worktree().Root()
 
 	pool.Add("1", path)
-	repo, err = pool.GetPos(1)
+	repo, err = pool.GetPos(ctx, 1)
 	require.Nil(err)
 	require.Equal("1", repo.ID)
 	require.NotNil(repo.Repo)
 
-	_, err = pool.GetPos(0)
+	_, err = pool.GetPos(ctx, 0)
 	require.Equal(git.ErrRepositoryNotExists, err)
-	_, err = pool.GetPos(2)
+	_, err = pool.GetPos(ctx, 2)
 	require.Equal(io.EOF, err)
 }
 
@@ -75,8 +80,9 @@ func TestRepositoryPoolGit(t *testing.T) {
 	id, err := pool.AddGit(path)
 	require.Equal(dirName, id)
 	require.Nil(err)
+	require.Equal(Plain, pool.repositories[id].kind)
 
-	repo, err := pool.GetPos(0)
+	repo, err := pool.GetPos(context.Background(), 0)
 	require.Equal(dirName, repo.ID)
 	require.NotNil(repo.Repo)
 	require.Nil(err)
@@ -100,6 +106,26 @@ func TestRepositoryPoolGit(t *testing.T) {
 	require.Equal(9, count)
 }
 
+func TestRepositoryPoolAddGitBare(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "gitquery-test-bare")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	_, err = git.PlainInit(tmpDir, true)
+	require.Nil(err)
+
+	pool := NewRepositoryPool()
+	id, err := pool.AddGit(tmpDir)
+	require.Nil(err)
+	require.Equal(Bare, pool.repositories[id].kind)
+
+	repo, err := pool.GetPos(context.Background(), 0)
+	require.Nil(err)
+	require.NotNil(repo.Repo)
+}
+
 func TestRepositoryPoolIterator(t *testing.T) {
 	require := require.New(t)
 
@@ -113,9 +139,10 @@ func TestRepositoryPoolIterator(t *testing.T) {
 	require.Nil(err)
 
 	count := 0
+	ctx := context.Background()
 
 	for {
-		repo, err := iter.Next()
+		repo, err := iter.Next(ctx)
 		if err != nil {
 			require.Equal(io.EOF, err)
 			break
@@ -161,7 +188,7 @@ func (d *testCommitIter) Close() error {
 func testRepoIter(num int, require *require.Assertions, pool *RepositoryPool) {
 	cIter := &testCommitIter{}
 
-	repoIter, err := NewRowRepoIter(pool, cIter)
+	repoIter, err := NewRowRepoIter(context.Background(), pool, cIter, RowRepoIterOptions{})
 	require.Nil(err)
 
 	count := 0
@@ -210,6 +237,150 @@ func TestRepositoryRowIterator(t *testing.T) {
 	wg.Wait()
 }
 
+func TestRepositoryRowIteratorWithCache(t *testing.T) {
+	require := require.New(t)
+
+	path := fixtures.Basic().ByTag("worktree").One().Worktree().Root()
+
+	pool := NewRepositoryPool()
+	max := 16
+
+	for i := 0; i < max; i++ {
+		pool.Add(strconv.Itoa(i), path)
+	}
+
+	// A cache much smaller than the pool forces evictions while several
+	// rowReaders are iterating the same repositories concurrently; if an
+	// eviction ever closed a handle still in use, testRepoIter's exact
+	// commit count would come up short or CommitObjects would error.
+	pool.WithCache(4)
+
+	var wg sync.WaitGroup
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			testRepoIter(max, require, &pool)
+		}()
+	}
+
+	wg.Wait()
+
+	stats := pool.Stats()
+	require.True(stats.Hits > 0, "expected cache hits from concurrent iterators, got %+v", stats)
+}
+
+func TestRowRepoIterSkipBrokenRepos(t *testing.T) {
+	require := require.New(t)
+
+	path := fixtures.Basic().ByTag("worktree").One().Worktree().Root()
+
+	pool := NewRepositoryPool()
+	pool.Add("0", path)
+	pool.Add("broken", "/directory/should/not/exist")
+	pool.Add("1", path)
+
+	var warnings []error
+	cIter := &testCommitIter{}
+
+	repoIter, err := NewRowRepoIter(context.Background(), &pool, cIter, RowRepoIterOptions{
+		SkipBrokenRepos: true,
+		OnBrokenRepo: func(err error) {
+			warnings = append(warnings, err)
+		},
+	})
+	require.Nil(err)
+
+	count := 0
+	for {
+		_, err := repoIter.Next()
+		if err == io.EOF {
+			break
+		}
+
+		require.Nil(err)
+		count++
+	}
+
+	require.Equal(9*2, count)
+	require.Len(warnings, 1)
+
+	err = repoIter.Close()
+	require.Error(err)
+}
+
+func TestRowRepoIterOptionsWorkers(t *testing.T) {
+	require := require.New(t)
+
+	pool := NewRepositoryPool()
+	for i := 0; i < 3; i++ {
+		pool.Add(strconv.Itoa(i), "/unused")
+	}
+
+	expected := 3
+	if n := runtime.NumCPU(); n < expected {
+		expected = n
+	}
+
+	require.Equal(expected, RowRepoIterOptions{}.workers(&pool))
+	require.Equal(1, RowRepoIterOptions{Workers: 1}.workers(&pool))
+}
+
+func TestRowRepoIterOptionsBuffers(t *testing.T) {
+	require := require.New(t)
+
+	path := fixtures.Basic().ByTag("worktree").One().Worktree().Root()
+
+	pool := NewRepositoryPool()
+	pool.Add("0", path)
+
+	cIter := &testCommitIter{}
+	repoIter, err := NewRowRepoIter(context.Background(), &pool, cIter, RowRepoIterOptions{
+		RepoBuffer: 5,
+		RowBuffer:  7,
+	})
+	require.Nil(err)
+	defer repoIter.Close()
+
+	require.Equal(5, cap(repoIter.repos))
+	require.Equal(7, cap(repoIter.rows))
+}
+
+func TestRepositoryPoolGetPosDeduplicatesConcurrentOpens(t *testing.T) {
+	require := require.New(t)
+
+	path := fixtures.Basic().ByTag("worktree").One().Worktree().Root()
+
+	pool := NewRepositoryPool()
+	pool.Add("0", path)
+	pool.WithCache(1)
+
+	var loads int32
+	orig := repoLoaders[Plain]
+	repoLoaders[Plain] = func(id, path string) (Repository, error) {
+		atomic.AddInt32(&loads, 1)
+		// Give other goroutines racing on GetPos a chance to pile up
+		// behind openLocks while this open is still in flight.
+		time.Sleep(10 * time.Millisecond)
+		return orig(id, path)
+	}
+	defer func() { repoLoaders[Plain] = orig }()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := pool.GetPos(context.Background(), 0)
+			require.NoError(err)
+		}()
+	}
+	wg.Wait()
+
+	require.EqualValues(1, atomic.LoadInt32(&loads))
+}
+
 func TestRepositoryPoolAddDir(t *testing.T) {
 	require := require.New(t)
 
@@ -236,7 +407,7 @@ func TestRepositoryPoolAddDir(t *testing.T) {
 	arrayExpected := make([]string, max)
 
 	for i := 0; i < max; i++ {
-		repo, err := pool.GetPos(i)
+		repo, err := pool.GetPos(context.Background(), i)
 		require.Nil(err)
 		arrayID[i] = repo.ID
 		arrayExpected[i] = strconv.Itoa(i)
@@ -261,3 +432,46 @@ func TestRepositoryPoolAddDir(t *testing.T) {
 
 	require.ElementsMatch(arrayExpected, arrayID)
 }
+
+func TestRepositoryPoolAddSiva(t *testing.T) {
+	require := require.New(t)
+
+	pool := NewRepositoryPool()
+	pool.AddSiva("repoA", "/path/to/repoA.siva")
+
+	require.Equal(repoEntry{kind: Siva, path: "/path/to/repoA.siva"}, pool.repositories["repoA"])
+}
+
+func TestRepositoryPoolAddDirDetectsSiva(t *testing.T) {
+	require := require.New(t)
+
+	tmpDir, err := ioutil.TempDir("", "gitquery-test-siva")
+	require.Nil(err)
+	defer os.RemoveAll(tmpDir)
+
+	sivaPath := filepath.Join(tmpDir, "repoB.siva")
+	require.Nil(ioutil.WriteFile(sivaPath, []byte("not a real siva file"), 0644))
+
+	pool := NewRepositoryPool()
+	require.Nil(pool.AddDir(tmpDir))
+
+	require.Equal(repoEntry{kind: Siva, path: sivaPath}, pool.repositories["repoB"])
+}
+
+func TestRepositoryPoolGetPosSivaRequiresCache(t *testing.T) {
+	require := require.New(t)
+
+	pool := NewRepositoryPool()
+	pool.AddSiva("repoA", "/path/to/repoA.siva")
+
+	_, err := pool.GetPos(context.Background(), 0)
+	require.Error(err)
+
+	pool.WithCache(1)
+
+	// With a cache configured, GetPos goes through the siva loader
+	// instead of being rejected outright; it still fails here because
+	// the path doesn't point to a real siva file.
+	_, err = pool.GetPos(context.Background(), 0)
+	require.Error(err)
+}